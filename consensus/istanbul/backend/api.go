@@ -0,0 +1,86 @@
+// Copyright 2020 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"errors"
+	"math/big"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/celo-blockchain/consensus"
+	"github.com/celo-org/celo-blockchain/consensus/istanbul/core"
+)
+
+// errUnknownBlock is returned by ReplicaState when the chain has no current
+// header yet, e.g. because the node is still syncing.
+var errUnknownBlock = errors.New("unknown block")
+
+// API exposes istanbul-specific methods for the RPC interface, registered
+// under the "istanbul" namespace. It is constructed by Backend.APIs and
+// not meant to be instantiated directly.
+type API struct {
+	chain   consensus.ChainHeaderReader
+	replica core.ReplicaState
+}
+
+// AddValidatingWindow schedules an additional [start, stop) block range
+// during which this node acts as primary; once any window is scheduled,
+// the node acts as replica for blocks outside every window.
+func (api *API) AddValidatingWindow(start, stop *big.Int) error {
+	return api.replica.AddValidatingWindow(start, stop)
+}
+
+// RemoveValidatingWindow cancels a previously scheduled validating window
+// identified by its start block.
+func (api *API) RemoveValidatingWindow(start *big.Int) error {
+	return api.replica.RemoveValidatingWindow(start)
+}
+
+// ListValidatingWindows returns every currently scheduled validating
+// window, including the legacy single start/stop pair if one is set.
+func (api *API) ListValidatingWindows() []core.ValidatingWindow {
+	return api.replica.ListValidatingWindows()
+}
+
+// ReplicaStateResult is the shape returned by the istanbul_replicaState RPC
+// method, letting tooling verify a primary/replica handoff is ready before
+// relying on it.
+type ReplicaStateResult struct {
+	IsReplica             bool                    `json:"isReplica"`
+	Enabled               bool                    `json:"enabled"`
+	Windows               []core.ValidatingWindow `json:"windows"`
+	Head                  *big.Int                `json:"head"`
+	IsPrimaryForNextBlock bool                    `json:"isPrimaryForNextBlock"`
+}
+
+// ReplicaState returns the node's full replica state: its current role, the
+// enabled flag, any pending validating windows, the current head sequence,
+// and whether it would be primary for the next block.
+func (api *API) ReplicaState() (*ReplicaStateResult, error) {
+	header := api.chain.CurrentHeader()
+	if header == nil {
+		return nil, errUnknownBlock
+	}
+	next := new(big.Int).Add(header.Number, common.Big1)
+	return &ReplicaStateResult{
+		IsReplica:             api.replica.IsReplica(),
+		Enabled:               api.replica.Enabled(),
+		Windows:               api.replica.ListValidatingWindows(),
+		Head:                  header.Number,
+		IsPrimaryForNextBlock: api.replica.IsPrimaryForSeq(next),
+	}, nil
+}
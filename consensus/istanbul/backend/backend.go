@@ -0,0 +1,60 @@
+// Copyright 2020 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"github.com/celo-org/celo-blockchain/consensus"
+	"github.com/celo-org/celo-blockchain/consensus/istanbul/core"
+	"github.com/celo-org/celo-blockchain/ethdb"
+	"github.com/celo-org/celo-blockchain/rpc"
+)
+
+// Backend is the istanbul consensus engine's RPC-facing handle. It owns
+// the replica state for this node and is responsible for making it
+// available over RPC once the chain is up.
+type Backend struct {
+	replica core.ReplicaState
+}
+
+// NewBackend loads any replica state persisted in db - restoring the
+// node's primary/replica role and pending validating windows across a
+// restart - before returning a Backend ready to serve RPC requests. This
+// must be called during engine startup, before block processing begins,
+// so a node coming back up mid-handoff does not fall back to isReplica
+// and risk double-signing with a hot spare that is also primary.
+func NewBackend(isReplica bool, db ethdb.Database) *Backend {
+	return &Backend{
+		replica: core.NewReplicaState(isReplica, db),
+	}
+}
+
+// APIs returns the RPC descriptors this backend exposes under the
+// "istanbul" namespace, including istanbul_replicaState and the
+// validating window management methods.
+func (b *Backend) APIs(chain consensus.ChainHeaderReader) []rpc.API {
+	return []rpc.API{
+		{
+			Namespace: "istanbul",
+			Version:   "1.0",
+			Service: &API{
+				chain:   chain,
+				replica: b.replica,
+			},
+			Public: true,
+		},
+	}
+}
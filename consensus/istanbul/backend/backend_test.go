@@ -0,0 +1,105 @@
+// Copyright 2020 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+package backend
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/celo-org/celo-blockchain/common"
+	"github.com/celo-org/celo-blockchain/core/types"
+	"github.com/celo-org/celo-blockchain/ethdb/memorydb"
+	"github.com/celo-org/celo-blockchain/params"
+)
+
+// fakeChainReader is a minimal consensus.ChainHeaderReader that only
+// answers CurrentHeader, which is all istanbul_replicaState needs.
+type fakeChainReader struct {
+	head *types.Header
+}
+
+func (r *fakeChainReader) Config() *params.ChainConfig                 { return nil }
+func (r *fakeChainReader) CurrentHeader() *types.Header                { return r.head }
+func (r *fakeChainReader) GetHeader(common.Hash, uint64) *types.Header { return nil }
+func (r *fakeChainReader) GetHeaderByNumber(uint64) *types.Header      { return nil }
+func (r *fakeChainReader) GetHeaderByHash(common.Hash) *types.Header   { return nil }
+
+func TestBackendAPIsRegistersIstanbulNamespace(t *testing.T) {
+	b := NewBackend(true, memorydb.New())
+	apis := b.APIs(&fakeChainReader{head: &types.Header{Number: big.NewInt(100)}})
+	if len(apis) != 1 {
+		t.Fatalf("expected exactly 1 API, got %d", len(apis))
+	}
+	if apis[0].Namespace != "istanbul" {
+		t.Errorf("expected namespace %q, got %q", "istanbul", apis[0].Namespace)
+	}
+	if _, ok := apis[0].Service.(*API); !ok {
+		t.Errorf("expected service to be *API, got %T", apis[0].Service)
+	}
+}
+
+func TestNewBackendLoadsPersistedReplicaState(t *testing.T) {
+	db := memorydb.New()
+
+	first := NewBackend(true, db)
+	api := first.APIs(&fakeChainReader{head: &types.Header{Number: big.NewInt(99)}})[0].Service.(*API)
+	if err := api.AddValidatingWindow(big.NewInt(100), big.NewInt(200)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Simulate a restart: a fresh Backend over the same db should recover
+	// the scheduled window and compute the same readiness for the next
+	// block as the original did.
+	second := NewBackend(false, db)
+	head := &types.Header{Number: big.NewInt(150)}
+	result, err := second.APIs(&fakeChainReader{head: head})[0].Service.(*API).ReplicaState()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !result.IsReplica {
+		t.Errorf("expected recovered backend to still be a replica")
+	}
+	if !result.IsPrimaryForNextBlock {
+		t.Errorf("expected recovered backend to be primary at head+1=151, inside the persisted window")
+	}
+	if len(result.Windows) != 1 {
+		t.Errorf("expected 1 persisted window, got %d", len(result.Windows))
+	}
+}
+
+// TestAddValidatingWindowRPCDoesNotPanicWithStopOnlyLegacyWindow guards
+// against a regression where an operator who previously called
+// SetStopValidatingBlock without SetStartValidatingBlock, then called the
+// RPC-exposed istanbul_addValidatingWindow, crashed the validator with a
+// nil pointer dereference instead of getting a clean accept/reject.
+func TestAddValidatingWindowRPCDoesNotPanicWithStopOnlyLegacyWindow(t *testing.T) {
+	b := NewBackend(false, memorydb.New())
+	api := b.APIs(&fakeChainReader{head: &types.Header{Number: big.NewInt(0)}})[0].Service.(*API)
+
+	if err := api.replica.SetStopValidatingBlock(big.NewInt(200)); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// Overlaps the stop-only legacy window: must be rejected, not panic.
+	if err := api.AddValidatingWindow(big.NewInt(150), big.NewInt(250)); err == nil {
+		t.Errorf("expected error overlapping legacy stop-only window, got nil")
+	}
+	// Disjoint from the stop-only legacy window: must be accepted, not panic.
+	if err := api.AddValidatingWindow(big.NewInt(300), big.NewInt(400)); err != nil {
+		t.Errorf("unexpected error adding disjoint window: %v", err)
+	}
+}
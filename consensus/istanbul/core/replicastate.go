@@ -0,0 +1,411 @@
+// Copyright 2020 The Celo Authors
+// This file is part of the celo library.
+//
+// The celo library is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Lesser General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// The celo library is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE. See the
+// GNU Lesser General Public License for more details.
+//
+// You should have received a copy of the GNU Lesser General Public License
+// along with the celo library. If not, see <http://www.gnu.org/licenses/>.
+
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"math/big"
+	"sort"
+	"sync"
+
+	"github.com/celo-org/celo-blockchain/ethdb"
+	"github.com/celo-org/celo-blockchain/log"
+)
+
+// replicaStateDBKey is the key under which the replica state snapshot is
+// persisted in the node's database.
+var replicaStateDBKey = []byte("istanbul-replica-state")
+
+var (
+	// errStartNotBeforeStop is returned when a start block is not strictly
+	// less than the stop block it is paired with.
+	errStartNotBeforeStop = errors.New("Start block number should be less than the stop block number")
+	// errStopNotAfterStart is returned when a stop block is not strictly
+	// greater than the start block it is paired with.
+	errStopNotAfterStart = errors.New("Stop block number should be greater than the start block number")
+	// errValidatingWindowOverlaps is returned when a requested validating
+	// window overlaps, or is directly adjacent to, an already scheduled one.
+	errValidatingWindowOverlaps = errors.New("validating window overlaps or is adjacent to an existing validating window")
+	// errValidatingWindowNotFound is returned by RemoveValidatingWindow when
+	// no scheduled window starts at the given block.
+	errValidatingWindowNotFound = errors.New("no validating window starting at that block")
+	// errValidatingWindowBoundsRequired is returned by AddValidatingWindow
+	// when either bound is nil; unlike the legacy start/stop pair, a
+	// window added through that API must be fully bounded.
+	errValidatingWindowBoundsRequired = errors.New("validating window start and stop must both be set")
+)
+
+// ValidatingWindow is a scheduled [Start, Stop) sequence range during which
+// the validator acts as primary, whether it was started as a primary or a
+// replica; outside every window it acts as a replica. A nil Stop means the
+// window never closes; this is only possible for the legacy window
+// surfaced by SetStartValidatingBlock/SetStopValidatingBlock; windows added
+// through AddValidatingWindow must always have both bounds set.
+type ValidatingWindow struct {
+	Start *big.Int
+	Stop  *big.Int
+}
+
+// ReplicaState tracks whether this validator is currently acting as
+// primary or replica, and any scheduled transitions between the two. It is
+// exported so that packages outside core (e.g. the istanbul RPC API) can
+// query and mutate it without reaching into the engine's internals.
+type ReplicaState interface {
+	IsPrimary() bool
+	IsReplica() bool
+	Enabled() bool
+	IsPrimaryForSeq(seq *big.Int) bool
+	MakePrimary()
+	MakeReplica()
+	SetStartValidatingBlock(block *big.Int) error
+	SetStopValidatingBlock(block *big.Int) error
+	AddValidatingWindow(start, stop *big.Int) error
+	RemoveValidatingWindow(start *big.Int) error
+	ListValidatingWindows() []ValidatingWindow
+}
+
+// replicaState is a package-local alias for ReplicaState, kept so existing
+// engine code can keep referring to the lower-cased name.
+type replicaState = ReplicaState
+
+// replicaStateImpl is the default replicaState implementation. A validator
+// is a replica (never proposes/signs blocks) unless enabled is false, in
+// which case isReplica alone decides its role, or the requested sequence
+// falls within one of its scheduled validating windows.
+type replicaStateImpl struct {
+	isReplica bool
+	enabled   bool
+
+	// startValidatingBlock/stopValidatingBlock are the original, single
+	// validating window. They are kept alongside windows below so that
+	// existing callers of SetStartValidatingBlock/SetStopValidatingBlock
+	// keep working unchanged.
+	startValidatingBlock *big.Int
+	stopValidatingBlock  *big.Int
+
+	// windows holds additional scheduled validating windows, kept sorted
+	// by ascending Start so the window that applies to a given sequence
+	// can be located with a binary search.
+	windows []ValidatingWindow
+
+	// db, if non-nil, is where the state above is snapshotted on every
+	// mutation and reloaded from on startup, so that a restart mid-handoff
+	// does not leave the node unsure of its own role.
+	db ethdb.Database
+
+	mu *sync.RWMutex
+}
+
+// replicaStateJSON is the on-disk representation of a replicaStateImpl
+// snapshot.
+type replicaStateJSON struct {
+	IsReplica            bool
+	Enabled              bool
+	StartValidatingBlock *big.Int
+	StopValidatingBlock  *big.Int
+	Windows              []ValidatingWindow
+}
+
+// NewReplicaState creates a ReplicaState that starts out as a primary or a
+// replica, with validating windows disabled, unless a prior snapshot for
+// it is found in db, in which case that snapshot is used instead. A nil db
+// disables persistence entirely. Callers (e.g. the istanbul backend) must
+// call this during engine startup, before block processing begins, so
+// that a restart mid-handoff recovers the node's intended role rather than
+// defaulting to isReplica.
+func NewReplicaState(isReplica bool, db ethdb.Database) ReplicaState {
+	return newReplicaStateImpl(isReplica, db)
+}
+
+// newReplicaStateImpl is the unexported constructor backing NewReplicaState
+// and the package's own tests.
+func newReplicaStateImpl(isReplica bool, db ethdb.Database) *replicaStateImpl {
+	rs := &replicaStateImpl{
+		isReplica: isReplica,
+		mu:        new(sync.RWMutex),
+		db:        db,
+	}
+	rs.loadFromDB()
+	return rs
+}
+
+// loadFromDB overwrites rs's in-memory state with the persisted snapshot,
+// if any. Callers must hold no lock; it is only ever called before rs is
+// shared with other goroutines.
+func (rs *replicaStateImpl) loadFromDB() {
+	if rs.db == nil {
+		return
+	}
+	enc, err := rs.db.Get(replicaStateDBKey)
+	if err != nil || len(enc) == 0 {
+		return
+	}
+	var stored replicaStateJSON
+	if err := json.Unmarshal(enc, &stored); err != nil {
+		log.Warn("Failed to decode persisted istanbul replica state, ignoring", "err", err)
+		return
+	}
+	rs.isReplica = stored.IsReplica
+	rs.enabled = stored.Enabled
+	rs.startValidatingBlock = stored.StartValidatingBlock
+	rs.stopValidatingBlock = stored.StopValidatingBlock
+	rs.windows = stored.Windows
+}
+
+// persistLocked snapshots rs's current state to rs.db, if configured.
+// Callers must hold rs.mu (for reading or writing).
+func (rs *replicaStateImpl) persistLocked() {
+	if rs.db == nil {
+		return
+	}
+	enc, err := json.Marshal(replicaStateJSON{
+		IsReplica:            rs.isReplica,
+		Enabled:              rs.enabled,
+		StartValidatingBlock: rs.startValidatingBlock,
+		StopValidatingBlock:  rs.stopValidatingBlock,
+		Windows:              rs.windows,
+	})
+	if err != nil {
+		log.Error("Failed to encode istanbul replica state", "err", err)
+		return
+	}
+	if err := rs.db.Put(replicaStateDBKey, enc); err != nil {
+		log.Error("Failed to persist istanbul replica state", "err", err)
+	}
+}
+
+func (rs *replicaStateImpl) IsPrimary() bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return !rs.isReplica
+}
+
+func (rs *replicaStateImpl) IsReplica() bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.isReplica
+}
+
+// Enabled reports whether the legacy start/stop pair or any scheduled
+// validating window is currently in effect.
+func (rs *replicaStateImpl) Enabled() bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+	return rs.enabled
+}
+
+// IsPrimaryForSeq returns whether this validator should act as the primary
+// for the given sequence number, taking any scheduled validating windows
+// into account.
+func (rs *replicaStateImpl) IsPrimaryForSeq(seq *big.Int) bool {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	if !rs.enabled {
+		return !rs.isReplica
+	}
+	return rs.inAnyWindow(seq)
+}
+
+// inAnyWindow reports whether seq falls within the legacy start/stop pair,
+// or within the scheduled window that contains it (or most closely
+// precedes it). Callers must hold rs.mu.
+func (rs *replicaStateImpl) inAnyWindow(seq *big.Int) bool {
+	// An unset legacy pair (both nil) must not be treated as an
+	// unbounded window - inWindow's nil-means-unbounded convention only
+	// applies once at least one half of the pair has actually been set.
+	if rs.legacyWindowSet() && inWindow(seq, rs.startValidatingBlock, rs.stopValidatingBlock) {
+		return true
+	}
+
+	// rs.windows is sorted by Start, so the only window that could still
+	// contain seq is the one immediately preceding it.
+	i := sort.Search(len(rs.windows), func(i int) bool {
+		return rs.windows[i].Start.Cmp(seq) > 0
+	})
+	if i == 0 {
+		return false
+	}
+	w := rs.windows[i-1]
+	return inWindow(seq, w.Start, w.Stop)
+}
+
+// inWindow reports whether seq lies in [start, stop), treating a nil start
+// as unbounded below and a nil stop as unbounded above.
+func inWindow(seq, start, stop *big.Int) bool {
+	if start != nil && seq.Cmp(start) < 0 {
+		return false
+	}
+	if stop != nil && seq.Cmp(stop) >= 0 {
+		return false
+	}
+	return true
+}
+
+func (rs *replicaStateImpl) MakePrimary() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.isReplica = false
+	rs.enabled = false
+	rs.startValidatingBlock = nil
+	rs.stopValidatingBlock = nil
+	rs.windows = nil
+	rs.persistLocked()
+}
+
+func (rs *replicaStateImpl) MakeReplica() {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.isReplica = true
+	rs.enabled = false
+	rs.startValidatingBlock = nil
+	rs.stopValidatingBlock = nil
+	rs.windows = nil
+	rs.persistLocked()
+}
+
+// SetStartValidatingBlock schedules the (legacy, single) validating window
+// to open at block. It must be strictly less than any already configured
+// stop block.
+func (rs *replicaStateImpl) SetStartValidatingBlock(block *big.Int) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.stopValidatingBlock != nil && block.Cmp(rs.stopValidatingBlock) >= 0 {
+		return errStartNotBeforeStop
+	}
+	rs.startValidatingBlock = block
+	rs.enabled = true
+	rs.persistLocked()
+	return nil
+}
+
+// SetStopValidatingBlock schedules the (legacy, single) validating window
+// to close at block. It must be strictly greater than any already
+// configured start block.
+func (rs *replicaStateImpl) SetStopValidatingBlock(block *big.Int) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.startValidatingBlock != nil && block.Cmp(rs.startValidatingBlock) <= 0 {
+		return errStopNotAfterStart
+	}
+	rs.stopValidatingBlock = block
+	rs.enabled = true
+	rs.persistLocked()
+	return nil
+}
+
+// AddValidatingWindow schedules an additional [start, stop) validating
+// window. Unlike the legacy start/stop pair, both bounds are required -
+// an open-ended window can only be expressed through
+// SetStartValidatingBlock/SetStopValidatingBlock. The window must be
+// internally ordered (start < stop) and must not overlap, or be directly
+// adjacent to, any window already scheduled - including the legacy
+// startValidatingBlock/stopValidatingBlock pair - so that the resulting
+// schedule is always unambiguous.
+func (rs *replicaStateImpl) AddValidatingWindow(start, stop *big.Int) error {
+	if start == nil || stop == nil {
+		return errValidatingWindowBoundsRequired
+	}
+	if start.Cmp(stop) >= 0 {
+		return errStartNotBeforeStop
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	if rs.legacyWindowSet() && windowsConflict(start, stop, rs.startValidatingBlock, rs.stopValidatingBlock) {
+		return errValidatingWindowOverlaps
+	}
+	for _, w := range rs.windows {
+		if windowsConflict(start, stop, w.Start, w.Stop) {
+			return errValidatingWindowOverlaps
+		}
+	}
+
+	rs.windows = append(rs.windows, ValidatingWindow{Start: start, Stop: stop})
+	sort.Slice(rs.windows, func(i, j int) bool {
+		return rs.windows[i].Start.Cmp(rs.windows[j].Start) < 0
+	})
+	rs.enabled = true
+	rs.persistLocked()
+	return nil
+}
+
+// RemoveValidatingWindow cancels a previously scheduled window identified
+// by its start block. It does not affect the legacy
+// startValidatingBlock/stopValidatingBlock pair.
+func (rs *replicaStateImpl) RemoveValidatingWindow(start *big.Int) error {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	for i, w := range rs.windows {
+		if w.Start.Cmp(start) == 0 {
+			rs.windows = append(rs.windows[:i], rs.windows[i+1:]...)
+			if len(rs.windows) == 0 && !rs.legacyWindowSet() {
+				rs.enabled = false
+			}
+			rs.persistLocked()
+			return nil
+		}
+	}
+	return errValidatingWindowNotFound
+}
+
+// ListValidatingWindows returns every currently scheduled validating
+// window: the legacy startValidatingBlock/stopValidatingBlock pair first,
+// if either half of it is set, followed by the windows added through
+// AddValidatingWindow in ascending Start order. The legacy pair is not
+// sorted in among the others.
+func (rs *replicaStateImpl) ListValidatingWindows() []ValidatingWindow {
+	rs.mu.RLock()
+	defer rs.mu.RUnlock()
+
+	windows := make([]ValidatingWindow, 0, len(rs.windows)+1)
+	if rs.legacyWindowSet() {
+		windows = append(windows, ValidatingWindow{Start: rs.startValidatingBlock, Stop: rs.stopValidatingBlock})
+	}
+	windows = append(windows, rs.windows...)
+	return windows
+}
+
+// legacyWindowSet reports whether the legacy startValidatingBlock/
+// stopValidatingBlock pair is currently active, i.e. either half of it has
+// been set via SetStartValidatingBlock/SetStopValidatingBlock. Only one
+// half needs to be set for the pair to be in effect - a nil start or stop
+// is treated by inWindow as unbounded, not absent. Callers must hold
+// rs.mu.
+func (rs *replicaStateImpl) legacyWindowSet() bool {
+	return rs.startValidatingBlock != nil || rs.stopValidatingBlock != nil
+}
+
+// windowsConflict reports whether the two [start, stop) windows overlap or
+// touch at a shared boundary. As in inWindow, a nil start is treated as
+// unbounded below and a nil stop as unbounded above, so every comparison
+// against a possibly-nil bound must be guarded rather than dereferenced
+// directly.
+func windowsConflict(aStart, aStop, bStart, bStop *big.Int) bool {
+	if aStop != nil && bStart != nil && bStart.Cmp(aStop) > 0 {
+		return false
+	}
+	if bStop != nil && aStart != nil && aStart.Cmp(bStop) > 0 {
+		return false
+	}
+	return true
+}